@@ -0,0 +1,985 @@
+// user-sessions is a small HTTP service that stores arbitrary, opaque
+// per-user UI state (the "session") for the Discovery Environment. Clients
+// PUT/POST a JSON blob and read it back later; this service never
+// interprets the contents.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultSlot = "default"
+
+// adminSecretEnvVar names the environment variable holding the shared
+// secret admin endpoints require in the X-Admin-Secret header. If it's
+// unset, the admin endpoints refuse every request.
+const adminSecretEnvVar = "USER_SESSIONS_ADMIN_SECRET"
+
+// maxImportLineBytes bounds a single NDJSON line accepted by
+// AdminImportSessionsRequest. Session payloads are arbitrary JSON blobs, so
+// this is sized well above bufio.Scanner's 64KB default rather than at it.
+const maxImportLineBytes = 16 * 1024 * 1024
+
+// UserSessionRecord represents a single stored session row. Username is
+// only populated by queries that join against the users table, such as
+// iterateSessions.
+type UserSessionRecord struct {
+	ID        string
+	Session   string
+	UserID    string
+	Username  string
+	Name      string
+	Version   int64
+	ExpiresAt *time.Time
+}
+
+// etag formats a session's version as an HTTP entity tag.
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// parseTTL reads a session TTL from the "ttl" query parameter or, failing
+// that, the X-Session-TTL header. A zero duration sets no new expiration: a
+// new session never expires, and an existing one keeps its current expiry.
+func parseTTL(request *http.Request) (time.Duration, error) {
+	raw := request.URL.Query().Get("ttl")
+	if raw == "" {
+		raw = request.Header.Get("X-Session-TTL")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(raw)
+}
+
+// reapedSessionsTotal counts sessions removed by Sessions.Reaper.
+var reapedSessionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "user_sessions_reaped_total",
+	Help: "The total number of expired sessions removed by the reaper.",
+})
+
+// Databaser is the set of operations Sessions needs from a backing store.
+// It's implemented by *SessionsDB for Postgres and by *MockDB in tests.
+type Databaser interface {
+	isUser(username string) (bool, error)
+	deleteSession(username string) error
+
+	listSessions(username string) ([]string, error)
+	getSession(username, name string) (*UserSessionRecord, error)
+	upsertSession(username, name, session string, ttl time.Duration) error
+	deleteSessionByName(username, name string) error
+	compareAndSwapSession(username, name string, expectedVersion int64, session string, ttl time.Duration) (int64, bool, error)
+	reapExpiredSessions() (int64, error)
+
+	iterateSessions(ctx context.Context, fn func(UserSessionRecord) error) error
+	bulkUpsert(ctx context.Context, records []UserSessionRecord, createMissingUsers bool) error
+}
+
+// Event describes a single session mutation, pushed to SSE subscribers of
+// the affected user.
+type Event struct {
+	Name    string          `json:"name"`
+	Session json.RawMessage `json:"session,omitempty"`
+	Version int64           `json:"version,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// Sessions wires a Databaser to an HTTP router.
+type Sessions struct {
+	db          Databaser
+	router      *mux.Router
+	reaperAlive int32
+
+	eventsMu  sync.Mutex
+	eventSubs map[string]map[chan Event]struct{}
+}
+
+// New creates a Sessions and registers its routes.
+func New(db Databaser) *Sessions {
+	s := &Sessions{
+		db:        db,
+		router:    mux.NewRouter(),
+		eventSubs: make(map[string]map[chan Event]struct{}),
+	}
+
+	s.router.HandleFunc("/healthz", s.HealthzRequest).Methods(http.MethodGet)
+	s.router.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+
+	s.router.HandleFunc("/admin/sessions", s.AdminExportSessionsRequest).Methods(http.MethodGet)
+	s.router.HandleFunc("/admin/sessions", s.AdminImportSessionsRequest).Methods(http.MethodPost)
+
+	s.router.HandleFunc("/{username}", s.GetRequest).Methods(http.MethodGet)
+	s.router.HandleFunc("/{username}", s.PutRequest).Methods(http.MethodPut)
+	s.router.HandleFunc("/{username}", s.PostRequest).Methods(http.MethodPost)
+	s.router.HandleFunc("/{username}", s.DeleteRequest).Methods(http.MethodDelete)
+
+	s.router.HandleFunc("/{username}/events", s.EventsRequest).Methods(http.MethodGet)
+
+	s.router.HandleFunc("/{username}/sessions", s.ListSessionsRequest).Methods(http.MethodGet)
+	s.router.HandleFunc("/{username}/sessions/{name}", s.GetSessionByNameRequest).Methods(http.MethodGet)
+	s.router.HandleFunc("/{username}/sessions/{name}", s.PutSessionByNameRequest).Methods(http.MethodPut)
+	s.router.HandleFunc("/{username}/sessions/{name}", s.PostSessionByNameRequest).Methods(http.MethodPost)
+	s.router.HandleFunc("/{username}/sessions/{name}", s.DeleteSessionByNameRequest).Methods(http.MethodDelete)
+
+	return s
+}
+
+// badRequest writes a 400 with msg as the body.
+func badRequest(writer http.ResponseWriter, msg string) {
+	log.Println(msg)
+	http.Error(writer, msg, http.StatusBadRequest)
+}
+
+// errored writes a 500 with msg as the body.
+func errored(writer http.ResponseWriter, msg string) {
+	log.Println(msg)
+	http.Error(writer, msg, http.StatusInternalServerError)
+}
+
+// notFound writes a 404 with msg as the body.
+func notFound(writer http.ResponseWriter, msg string) {
+	http.Error(writer, msg, http.StatusNotFound)
+}
+
+// convert turns a stored record's raw JSON session into a map, transparently
+// unwrapping the legacy `{"session": {...}}` storage format some rows still
+// have. When wrap is true the returned map is re-wrapped under a "session"
+// key so API responses keep their historical shape.
+func convert(record *UserSessionRecord, wrap bool) (map[string]interface{}, error) {
+	if record.Session == "" {
+		return make(map[string]interface{}), nil
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(record.Session), &parsed); err != nil {
+		return nil, err
+	}
+
+	if inner, ok := parsed["session"].(map[string]interface{}); ok {
+		parsed = inner
+	}
+
+	if wrap {
+		return map[string]interface{}{"session": parsed}, nil
+	}
+
+	return parsed, nil
+}
+
+func convertedBytes(record *UserSessionRecord, wrap bool) ([]byte, error) {
+	data, err := convert(record, wrap)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
+
+// subscribe registers a new event channel for username and returns it. The
+// caller must unsubscribe it when done listening.
+func (s *Sessions) subscribe(username string) chan Event {
+	ch := make(chan Event, 8)
+
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+
+	if s.eventSubs[username] == nil {
+		s.eventSubs[username] = make(map[chan Event]struct{})
+	}
+	s.eventSubs[username][ch] = struct{}{}
+
+	return ch
+}
+
+// unsubscribe removes a channel previously returned by subscribe. The
+// channel is not closed: publish may still hold a reference to it from a
+// snapshot taken concurrently, and a send on a closed channel panics. The
+// channel is simply left for the garbage collector once no one can reach
+// it anymore.
+func (s *Sessions) unsubscribe(username string, ch chan Event) {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+
+	if subs, ok := s.eventSubs[username]; ok {
+		delete(subs, ch)
+		if len(subs) == 0 {
+			delete(s.eventSubs, username)
+		}
+	}
+}
+
+// publish fans event out to every subscriber of username. Subscribers that
+// aren't keeping up are skipped rather than blocking the writer.
+func (s *Sessions) publish(username string, event Event) {
+	s.eventsMu.Lock()
+	subs := s.eventSubs[username]
+	chans := make([]chan Event, 0, len(subs))
+	for ch := range subs {
+		chans = append(chans, ch)
+	}
+	s.eventsMu.Unlock()
+
+	for _, ch := range chans {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// EventsRequest handles GET /{username}/events, upgrading to a
+// text/event-stream of the user's session mutations until the client
+// disconnects.
+func (s *Sessions) EventsRequest(writer http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["username"]
+
+	present, err := s.db.isUser(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error looking up user %s: %s", username, err))
+		return
+	}
+	if !present {
+		notFound(writer, fmt.Sprintf("user %s not found", username))
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		errored(writer, "streaming not supported")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := s.subscribe(username)
+	defer s.unsubscribe(username, ch)
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("error marshaling event for %s: %s", username, err)
+				continue
+			}
+			fmt.Fprintf(writer, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// GetRequest handles GET /{username}, returning the user's default-slot
+// session unwrapped, with its version reported as an ETag. A missing or
+// expired session is reported as a 404.
+func (s *Sessions) GetRequest(writer http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["username"]
+
+	present, err := s.db.isUser(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error looking up user %s: %s", username, err))
+		return
+	}
+	if !present {
+		notFound(writer, fmt.Sprintf("user %s not found", username))
+		return
+	}
+
+	record, err := s.db.getSession(username, defaultSlot)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error getting session for %s: %s", username, err))
+		return
+	}
+	if record == nil {
+		notFound(writer, fmt.Sprintf("no session for %s", username))
+		return
+	}
+
+	body, err := convertedBytes(record, false)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error getting session for %s: %s", username, err))
+		return
+	}
+
+	writer.Header().Set("ETag", etag(record.Version))
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
+}
+
+// HealthzRequest reports 200 while the reaper goroutine is running, and 503
+// otherwise.
+func (s *Sessions) HealthzRequest(writer http.ResponseWriter, request *http.Request) {
+	alive := atomic.LoadInt32(&s.reaperAlive) == 1
+
+	status := http.StatusOK
+	if !alive {
+		status = http.StatusServiceUnavailable
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(map[string]bool{"reaper": alive})
+}
+
+// Reaper periodically deletes expired sessions until ctx is done. It runs
+// once immediately, then every interval.
+func (s *Sessions) Reaper(ctx context.Context, interval time.Duration) {
+	atomic.StoreInt32(&s.reaperAlive, 1)
+	defer atomic.StoreInt32(&s.reaperAlive, 0)
+
+	s.reapOnce()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reapOnce()
+		}
+	}
+}
+
+func (s *Sessions) reapOnce() {
+	n, err := s.db.reapExpiredSessions()
+	if err != nil {
+		log.Printf("error reaping expired sessions: %s", err)
+		return
+	}
+	if n > 0 {
+		reapedSessionsTotal.Add(float64(n))
+	}
+}
+
+// PutRequest handles PUT /{username}, creating or replacing the user's
+// default-slot session, subject to optimistic concurrency control.
+func (s *Sessions) PutRequest(writer http.ResponseWriter, request *http.Request) {
+	s.writeSlotRequest(writer, request, defaultSlot)
+}
+
+// PostRequest handles POST /{username}, replacing the user's default-slot
+// session, subject to optimistic concurrency control.
+func (s *Sessions) PostRequest(writer http.ResponseWriter, request *http.Request) {
+	s.writeSlotRequest(writer, request, defaultSlot)
+}
+
+// writeSlotRequest handles the shared body of every session-writing route:
+// it enforces the If-Match/version check (unless ?force=true is given),
+// stores the new body, and writes back the resulting record wrapped under
+// a "session" key with its new version as an ETag. If the stored session's
+// expiry has already passed when it is read back, a 404 is reported.
+func (s *Sessions) writeSlotRequest(writer http.ResponseWriter, request *http.Request, name string) {
+	username := mux.Vars(request)["username"]
+
+	present, err := s.db.isUser(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error looking up user %s: %s", username, err))
+		return
+	}
+	if !present {
+		notFound(writer, fmt.Sprintf("user %s not found", username))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("error reading body: %s", err))
+		return
+	}
+
+	ttl, err := parseTTL(request)
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("invalid session TTL: %s", err))
+		return
+	}
+
+	force := request.URL.Query().Get("force") == "true"
+
+	status, err := s.writeSession(username, name, string(body), request.Header.Get("If-Match"), force, ttl)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error storing session %s for %s: %s", name, username, err))
+		return
+	}
+	if status != http.StatusOK {
+		http.Error(writer, http.StatusText(status), status)
+		return
+	}
+
+	record, err := s.db.getSession(username, name)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error getting session %s for %s: %s", name, username, err))
+		return
+	}
+	if record == nil {
+		notFound(writer, fmt.Sprintf("session %s for %s expired before it could be read back", name, username))
+		return
+	}
+
+	plain, err := convertedBytes(record, false)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error getting session %s for %s: %s", name, username, err))
+		return
+	}
+	s.publish(username, Event{Name: name, Session: json.RawMessage(plain), Version: record.Version})
+
+	out, err := convertedBytes(record, true)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error getting session %s for %s: %s", name, username, err))
+		return
+	}
+
+	writer.Header().Set("ETag", etag(record.Version))
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(out)
+}
+
+// writeSession stores session under username/name, enforcing a compare-
+// and-swap against ifMatch's version unless the slot doesn't exist yet or
+// force is set. It returns the HTTP status the caller should report:
+// http.StatusOK on success, http.StatusPreconditionRequired if a version
+// check was required but no If-Match header was given,
+// http.StatusBadRequest if the If-Match value isn't a version number, or
+// http.StatusPreconditionFailed if the given version is stale.
+func (s *Sessions) writeSession(username, name, session, ifMatch string, force bool, ttl time.Duration) (int, error) {
+	existing, err := s.db.getSession(username, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if existing == nil || force {
+		if err = s.db.upsertSession(username, name, session, ttl); err != nil {
+			return 0, err
+		}
+		return http.StatusOK, nil
+	}
+
+	ifMatch = strings.Trim(ifMatch, `"`)
+	if ifMatch == "" {
+		return http.StatusPreconditionRequired, nil
+	}
+
+	expectedVersion, err := strconv.ParseInt(ifMatch, 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	_, ok, err := s.db.compareAndSwapSession(username, name, expectedVersion, session, ttl)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return http.StatusPreconditionFailed, nil
+	}
+
+	return http.StatusOK, nil
+}
+
+// DeleteRequest handles DELETE /{username}, removing the default-slot
+// session.
+func (s *Sessions) DeleteRequest(writer http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["username"]
+
+	present, err := s.db.isUser(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error looking up user %s: %s", username, err))
+		return
+	}
+	if !present {
+		notFound(writer, fmt.Sprintf("user %s not found", username))
+		return
+	}
+
+	if err := s.db.deleteSession(username); err != nil {
+		errored(writer, fmt.Sprintf("error deleting session for %s: %s", username, err))
+		return
+	}
+	s.publish(username, Event{Name: defaultSlot, Deleted: true})
+
+	writer.WriteHeader(http.StatusOK)
+}
+
+// ListSessionsRequest handles GET /{username}/sessions, returning the
+// names of every session slot the user has.
+func (s *Sessions) ListSessionsRequest(writer http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["username"]
+
+	present, err := s.db.isUser(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error looking up user %s: %s", username, err))
+		return
+	}
+	if !present {
+		notFound(writer, fmt.Sprintf("user %s not found", username))
+		return
+	}
+
+	names, err := s.db.listSessions(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error listing sessions for %s: %s", username, err))
+		return
+	}
+
+	body, err := json.Marshal(names)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error marshaling session list for %s: %s", username, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
+}
+
+// GetSessionByNameRequest handles GET /{username}/sessions/{name}.
+func (s *Sessions) GetSessionByNameRequest(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username, name := vars["username"], vars["name"]
+
+	present, err := s.db.isUser(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error looking up user %s: %s", username, err))
+		return
+	}
+	if !present {
+		notFound(writer, fmt.Sprintf("user %s not found", username))
+		return
+	}
+
+	record, err := s.db.getSession(username, name)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error getting session %s for %s: %s", name, username, err))
+		return
+	}
+	if record == nil {
+		notFound(writer, fmt.Sprintf("no session named %s for %s", name, username))
+		return
+	}
+
+	body, err := convertedBytes(record, false)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error converting session %s for %s: %s", name, username, err))
+		return
+	}
+
+	writer.Header().Set("ETag", etag(record.Version))
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
+}
+
+// PutSessionByNameRequest handles PUT /{username}/sessions/{name}, subject
+// to optimistic concurrency control.
+func (s *Sessions) PutSessionByNameRequest(writer http.ResponseWriter, request *http.Request) {
+	s.writeSlotRequest(writer, request, mux.Vars(request)["name"])
+}
+
+// PostSessionByNameRequest handles POST /{username}/sessions/{name},
+// subject to optimistic concurrency control.
+func (s *Sessions) PostSessionByNameRequest(writer http.ResponseWriter, request *http.Request) {
+	s.writeSlotRequest(writer, request, mux.Vars(request)["name"])
+}
+
+// DeleteSessionByNameRequest handles DELETE /{username}/sessions/{name}.
+func (s *Sessions) DeleteSessionByNameRequest(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username, name := vars["username"], vars["name"]
+
+	present, err := s.db.isUser(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("error looking up user %s: %s", username, err))
+		return
+	}
+	if !present {
+		notFound(writer, fmt.Sprintf("user %s not found", username))
+		return
+	}
+
+	if err := s.db.deleteSessionByName(username, name); err != nil {
+		errored(writer, fmt.Sprintf("error deleting session %s for %s: %s", name, username, err))
+		return
+	}
+	s.publish(username, Event{Name: name, Deleted: true})
+
+	writer.WriteHeader(http.StatusOK)
+}
+
+// adminSessionRecord is the NDJSON wire format for GET/POST /admin/sessions.
+type adminSessionRecord struct {
+	Username  string          `json:"username"`
+	Name      string          `json:"name,omitempty"`
+	Session   json.RawMessage `json:"session"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+}
+
+// adminAuthorized reports whether request carries the shared secret
+// configured via adminSecretEnvVar. With no secret configured, every
+// request is refused. The comparison runs in constant time since this
+// endpoint can dump or overwrite every user's session data.
+func (s *Sessions) adminAuthorized(request *http.Request) bool {
+	secret := os.Getenv(adminSecretEnvVar)
+	if secret == "" {
+		return false
+	}
+	given := request.Header.Get("X-Admin-Secret")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// AdminExportSessionsRequest handles GET /admin/sessions, streaming every
+// stored session as a newline-delimited JSON adminSessionRecord.
+func (s *Sessions) AdminExportSessionsRequest(writer http.ResponseWriter, request *http.Request) {
+	if !s.adminAuthorized(request) {
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+
+	flusher, _ := writer.(http.Flusher)
+	enc := json.NewEncoder(writer)
+
+	err := s.db.iterateSessions(request.Context(), func(record UserSessionRecord) error {
+		session := record.Session
+		if session == "" {
+			session = "{}"
+		}
+		if err := enc.Encode(adminSessionRecord{
+			Username:  record.Username,
+			Name:      record.Name,
+			Session:   json.RawMessage(session),
+			ExpiresAt: record.ExpiresAt,
+		}); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("error streaming session export: %s", err)
+	}
+}
+
+// AdminImportSessionsRequest handles POST /admin/sessions, bulk-loading the
+// newline-delimited JSON records AdminExportSessionsRequest produces.
+// Unknown usernames are skipped unless ?create-missing-users=true is given.
+func (s *Sessions) AdminImportSessionsRequest(writer http.ResponseWriter, request *http.Request) {
+	if !s.adminAuthorized(request) {
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	createMissingUsers := request.URL.Query().Get("create-missing-users") == "true"
+
+	var records []UserSessionRecord
+	scanner := bufio.NewScanner(request.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineBytes)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var rec adminSessionRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			badRequest(writer, fmt.Sprintf("error parsing session record: %s", err))
+			return
+		}
+
+		name := rec.Name
+		if name == "" {
+			name = defaultSlot
+		}
+
+		records = append(records, UserSessionRecord{
+			Username:  rec.Username,
+			Name:      name,
+			Session:   string(rec.Session),
+			ExpiresAt: rec.ExpiresAt,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		badRequest(writer, fmt.Sprintf("error reading request body: %s", err))
+		return
+	}
+
+	if err := s.db.bulkUpsert(request.Context(), records, createMissingUsers); err != nil {
+		errored(writer, fmt.Sprintf("error bulk loading sessions: %s", err))
+		return
+	}
+
+	writer.WriteHeader(http.StatusOK)
+}
+
+// SessionsDB is the Postgres-backed Databaser.
+type SessionsDB struct {
+	db *sql.DB
+}
+
+// NewSessionsDB creates a new *SessionsDB wrapping db.
+func NewSessionsDB(db *sql.DB) *SessionsDB {
+	return &SessionsDB{db: db}
+}
+
+func (p *SessionsDB) userID(username string) (string, error) {
+	var id string
+	query := `SELECT id FROM users WHERE username = $1`
+	err := p.db.QueryRow(query, username).Scan(&id)
+	return id, err
+}
+
+func (p *SessionsDB) isUser(username string) (bool, error) {
+	var count int64
+	query := `SELECT COUNT(*) FROM ( SELECT DISTINCT id FROM users WHERE username = $1 ) AS check_user`
+	if err := p.db.QueryRow(query, username).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (p *SessionsDB) deleteSession(username string) error {
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+
+	query := `DELETE FROM ONLY user_sessions WHERE user_id = $1 AND name = 'default'`
+	_, err = p.db.Exec(query, userID)
+	return err
+}
+
+func (p *SessionsDB) listSessions(username string) ([]string, error) {
+	var names []string
+
+	query := `SELECT s.name AS name FROM user_sessions s, users u WHERE s.user_id = u.id AND u.username = $1 AND (s.expires_at IS NULL OR s.expires_at > now())`
+	rows, err := p.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+func (p *SessionsDB) getSession(username, name string) (*UserSessionRecord, error) {
+	var record UserSessionRecord
+	record.Name = name
+
+	query := `SELECT s.id AS id, s.user_id AS user_id, s.session AS session, s.version AS version FROM user_sessions s, users u WHERE s.user_id = u.id AND u.username = $1 AND s.name = $2 AND (s.expires_at IS NULL OR s.expires_at > now())`
+	err := p.db.QueryRow(query, username, name).Scan(&record.ID, &record.UserID, &record.Session, &record.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// expiresAt converts a TTL into the value to bind for the expires_at
+// column: nil when ttl is zero or negative, otherwise now()+ttl. The write
+// queries COALESCE a nil value to the row's existing expiry, so nil means no
+// expiration only for a newly inserted row.
+func expiresAt(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return nil
+	}
+	return time.Now().Add(ttl)
+}
+
+func (p *SessionsDB) upsertSession(username, name, session string, ttl time.Duration) error {
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO user_sessions (user_id, session, name, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, name) DO UPDATE SET session = EXCLUDED.session, version = user_sessions.version + 1, expires_at = COALESCE(EXCLUDED.expires_at, user_sessions.expires_at)`
+	_, err = p.db.Exec(query, userID, session, name, expiresAt(ttl))
+	return err
+}
+
+func (p *SessionsDB) deleteSessionByName(username, name string) error {
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+
+	query := `DELETE FROM ONLY user_sessions WHERE user_id = $1 AND name = $2`
+	_, err = p.db.Exec(query, userID, name)
+	return err
+}
+
+// compareAndSwapSession atomically updates a session only if its stored
+// version still matches expectedVersion, returning the new version on
+// success. ok is false (with no error) when the slot doesn't exist or its
+// version has moved on, so the caller can report a 412 Precondition Failed.
+func (p *SessionsDB) compareAndSwapSession(username, name string, expectedVersion int64, session string, ttl time.Duration) (int64, bool, error) {
+	userID, err := p.userID(username)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var newVersion int64
+	query := `UPDATE ONLY user_sessions SET session = $3, version = version + 1, expires_at = COALESCE($5, user_sessions.expires_at)
+		WHERE user_id = $1 AND name = $2 AND version = $4 RETURNING version`
+	err = p.db.QueryRow(query, userID, name, session, expectedVersion, expiresAt(ttl)).Scan(&newVersion)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return newVersion, true, nil
+}
+
+// reapExpiredSessions deletes every session whose expiry has passed,
+// returning the number of rows removed.
+func (p *SessionsDB) reapExpiredSessions() (int64, error) {
+	result, err := p.db.Exec(`DELETE FROM user_sessions WHERE expires_at < now()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// iterateSessions calls fn once per stored session, across every user,
+// streaming rows from the database rather than loading them all into
+// memory so it stays bounded for large tenants.
+func (p *SessionsDB) iterateSessions(ctx context.Context, fn func(UserSessionRecord) error) error {
+	query := `SELECT s.user_id AS user_id, s.session AS session, s.name AS name, s.version AS version, u.username AS username, s.expires_at AS expires_at
+		FROM user_sessions s, users u WHERE s.user_id = u.id`
+	rows, err := p.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record UserSessionRecord
+		var expiresAt sql.NullTime
+		if err = rows.Scan(&record.UserID, &record.Session, &record.Name, &record.Version, &record.Username, &expiresAt); err != nil {
+			return err
+		}
+		if expiresAt.Valid {
+			record.ExpiresAt = &expiresAt.Time
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// bulkUpsert loads records in a single transaction, upserting each by
+// (user_id, name). Records for a username with no matching user are
+// skipped unless createMissingUsers is set, in which case a placeholder
+// user row is created for them. Any error rolls the whole transaction back.
+func (p *SessionsDB) bulkUpsert(ctx context.Context, records []UserSessionRecord, createMissingUsers bool) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		var userID string
+		err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = $1`, record.Username).Scan(&userID)
+		if err == sql.ErrNoRows {
+			if !createMissingUsers {
+				continue
+			}
+			if err = tx.QueryRowContext(ctx, `INSERT INTO users (username) VALUES ($1) RETURNING id`, record.Username).Scan(&userID); err != nil {
+				tx.Rollback()
+				return err
+			}
+		} else if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		var expiresAt interface{}
+		if record.ExpiresAt != nil {
+			expiresAt = *record.ExpiresAt
+		}
+
+		query := `INSERT INTO user_sessions (user_id, session, name, expires_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, name) DO UPDATE SET session = EXCLUDED.session, version = user_sessions.version + 1, expires_at = EXCLUDED.expires_at`
+		if _, err = tx.ExecContext(ctx, query, userID, record.Session, record.Name, expiresAt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// fixAddr ensures addr has a leading colon, as required by http.ListenAndServe.
+func fixAddr(addr string) string {
+	if !strings.HasPrefix(addr, ":") {
+		return ":" + addr
+	}
+	return addr
+}
+
+func main() {
+	var (
+		port         = flag.String("port", "60000", "The port number to listen on")
+		dbURI        = flag.String("db", "", "The postgres connection URI")
+		reapInterval = flag.Duration("reap-interval", time.Minute, "How often to scan for and remove expired sessions")
+	)
+	flag.Parse()
+
+	db, err := sql.Open("postgres", *dbURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	sessions := New(NewSessionsDB(db))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sessions.Reaper(ctx, *reapInterval)
+
+	log.Printf("listening on %s", fixAddr(*port))
+	log.Fatal(http.ListenAndServe(fixAddr(*port), sessions.router))
+}
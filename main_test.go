@@ -1,26 +1,43 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
 
+type mockSlot struct {
+	session   string
+	version   int64
+	expiresAt time.Time
+}
+
+func (s mockSlot) expired() bool {
+	return !s.expiresAt.IsZero() && s.expiresAt.Before(time.Now())
+}
+
 type MockDB struct {
-	storage map[string]map[string]interface{}
+	storage map[string]map[string]mockSlot
 	users   map[string]bool
 }
 
 func NewMockDB() *MockDB {
 	return &MockDB{
-		storage: make(map[string]map[string]interface{}),
+		storage: make(map[string]map[string]mockSlot),
 		users:   make(map[string]bool),
 	}
 }
@@ -30,48 +47,156 @@ func (m *MockDB) isUser(username string) (bool, error) {
 	return ok, nil
 }
 
-func (m *MockDB) hasSessions(username string) (bool, error) {
-	stored, ok := m.storage[username]
+func (m *MockDB) deleteSession(username string) error {
+	return m.deleteSessionByName(username, defaultSlot)
+}
+
+func (m *MockDB) listSessions(username string) ([]string, error) {
+	slots, ok := m.storage[username]
 	if !ok {
-		return false, nil
+		return []string{}, nil
 	}
-	if stored == nil {
-		return false, nil
+
+	names := make([]string, 0, len(slots))
+	for name, slot := range slots {
+		if slot.expired() {
+			continue
+		}
+		names = append(names, name)
 	}
-	prefs, ok := m.storage[username]["user-sessions"].(string)
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MockDB) getSession(username, name string) (*UserSessionRecord, error) {
+	slots, ok := m.storage[username]
 	if !ok {
-		return false, nil
+		return nil, nil
 	}
-	if prefs == "" {
-		return false, nil
+	slot, ok := slots[name]
+	if !ok || slot.expired() {
+		return nil, nil
 	}
-	return true, nil
+	record := &UserSessionRecord{ID: "id", Session: slot.session, UserID: "user-id", Name: name, Version: slot.version}
+	if !slot.expiresAt.IsZero() {
+		expiresAt := slot.expiresAt
+		record.ExpiresAt = &expiresAt
+	}
+	return record, nil
 }
 
-func (m *MockDB) getSessions(username string) ([]UserSessionRecord, error) {
-	return []UserSessionRecord{
-		UserSessionRecord{
-			ID:      "id",
-			Session: m.storage[username]["user-sessions"].(string),
-			UserID:  "user-id",
-		},
-	}, nil
+func mockExpiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
 }
 
-func (m *MockDB) insertSession(username, session string) error {
-	if _, ok := m.storage[username]["user-sessions"]; !ok {
-		m.storage[username] = make(map[string]interface{})
+func (m *MockDB) upsertSession(username, name, session string, ttl time.Duration) error {
+	if _, ok := m.storage[username]; !ok {
+		m.storage[username] = make(map[string]mockSlot)
 	}
-	m.storage[username]["user-sessions"] = session
+	existing := m.storage[username][name]
+	expiresAt := existing.expiresAt
+	if ttl > 0 {
+		expiresAt = mockExpiresAt(ttl)
+	}
+	m.storage[username][name] = mockSlot{session: session, version: existing.version + 1, expiresAt: expiresAt}
 	return nil
 }
 
-func (m *MockDB) updateSession(username, prefs string) error {
-	return m.insertSession(username, prefs)
+func (m *MockDB) deleteSessionByName(username, name string) error {
+	if slots, ok := m.storage[username]; ok {
+		delete(slots, name)
+	}
+	return nil
 }
 
-func (m *MockDB) deleteSession(username string) error {
-	delete(m.storage, username)
+func (m *MockDB) compareAndSwapSession(username, name string, expectedVersion int64, session string, ttl time.Duration) (int64, bool, error) {
+	slots, ok := m.storage[username]
+	if !ok {
+		return 0, false, nil
+	}
+	slot, ok := slots[name]
+	if !ok || slot.version != expectedVersion {
+		return 0, false, nil
+	}
+
+	newVersion := slot.version + 1
+	expiresAt := slot.expiresAt
+	if ttl > 0 {
+		expiresAt = mockExpiresAt(ttl)
+	}
+	slots[name] = mockSlot{session: session, version: newVersion, expiresAt: expiresAt}
+	return newVersion, true, nil
+}
+
+func (m *MockDB) reapExpiredSessions() (int64, error) {
+	var count int64
+	for _, slots := range m.storage {
+		for name, slot := range slots {
+			if slot.expired() {
+				delete(slots, name)
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func (m *MockDB) iterateSessions(ctx context.Context, fn func(UserSessionRecord) error) error {
+	usernames := make([]string, 0, len(m.storage))
+	for username := range m.storage {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		names := make([]string, 0, len(m.storage[username]))
+		for name := range m.storage[username] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			slot := m.storage[username][name]
+			record := UserSessionRecord{Username: username, Name: name, Session: slot.session, Version: slot.version}
+			if !slot.expiresAt.IsZero() {
+				expiresAt := slot.expiresAt
+				record.ExpiresAt = &expiresAt
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MockDB) bulkUpsert(ctx context.Context, records []UserSessionRecord, createMissingUsers bool) error {
+	for _, record := range records {
+		if !m.users[record.Username] {
+			if !createMissingUsers {
+				continue
+			}
+			m.users[record.Username] = true
+		}
+
+		name := record.Name
+		if name == "" {
+			name = defaultSlot
+		}
+		if err := m.upsertSession(record.Username, name, record.Session, 0); err != nil {
+			return err
+		}
+
+		slot := m.storage[record.Username][name]
+		slot.expiresAt = time.Time{}
+		if record.ExpiresAt != nil {
+			slot.expiresAt = *record.ExpiresAt
+		}
+		m.storage[record.Username][name] = slot
+	}
 	return nil
 }
 
@@ -197,43 +322,13 @@ func TestErrored(t *testing.T) {
 	}
 }
 
-func TestGetUserSessionForRequest(t *testing.T) {
-	mock := NewMockDB()
-	n := New(mock)
-
-	expected := []byte("{\"one\":\"two\"}")
-	expectedWrapped := []byte("{\"session\":{\"one\":\"two\"}}")
-	mock.users["test-user"] = true
-	if err := mock.insertSession("test-user", string(expected)); err != nil {
-		t.Error(err)
-	}
-
-	actualWrapped, err := n.getUserSessionForRequest("test-user", true)
-	if err != nil {
-		t.Error(err)
-	}
-
-	if !bytes.Equal(actualWrapped, expectedWrapped) {
-		t.Errorf("The return value was '%s' instead of '%s'", actualWrapped, expectedWrapped)
-	}
-
-	actual, err := n.getUserSessionForRequest("test-user", false)
-	if err != nil {
-		t.Error(err)
-	}
-
-	if !bytes.Equal(actual, expected) {
-		t.Errorf("The return value was '%s' instead of '%s'", actual, expected)
-	}
-}
-
 func TestGetRequest(t *testing.T) {
 	mock := NewMockDB()
 	n := New(mock)
 
 	expected := []byte("{\"one\":\"two\"}")
 	mock.users["test-user"] = true
-	if err := mock.insertSession("test-user", string(expected)); err != nil {
+	if err := mock.upsertSession("test-user", defaultSlot, string(expected), 0); err != nil {
 		t.Error(err)
 	}
 
@@ -321,7 +416,7 @@ func TestPostRequest(t *testing.T) {
 	expected := []byte(`{"one":"two"}`)
 
 	mock.users[username] = true
-	if err := mock.insertSession(username, string(expected)); err != nil {
+	if err := mock.upsertSession(username, defaultSlot, string(expected), 0); err != nil {
 		t.Error(err)
 	}
 
@@ -334,12 +429,17 @@ func TestPostRequest(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	req.Header.Set("If-Match", `"1"`)
 
 	res, err := httpClient.Do(req)
 	if err != nil {
 		t.Error(err)
 	}
 
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("POST status code was %d instead of %d", res.StatusCode, http.StatusOK)
+	}
+
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		t.Error(err)
@@ -373,7 +473,7 @@ func TestDelete(t *testing.T) {
 	mock.users[username] = true
 	n := New(mock)
 
-	if err := mock.insertSession(username, string(expected)); err != nil {
+	if err := mock.upsertSession(username, defaultSlot, string(expected), 0); err != nil {
 		t.Error(err)
 	}
 
@@ -449,6 +549,31 @@ func TestDeleteUnstored(t *testing.T) {
 	}
 }
 
+func TestDeleteUnknownUser(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, "test-user")
+	httpClient := &http.Client{}
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		t.Error(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE status code for an unknown user was %d instead of %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
 func TestNewSessionsDB(t *testing.T) {
 	db, _, err := sqlmock.New()
 	if err != nil {
@@ -496,7 +621,7 @@ func TestIsUser(t *testing.T) {
 	}
 }
 
-func TestHasSessions(t *testing.T) {
+func TestDeleteSession(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("error creating the mock db: %s", err)
@@ -508,25 +633,51 @@ func TestHasSessions(t *testing.T) {
 		t.Error("NewSessionsDB returned nil")
 	}
 
-	mock.ExpectQuery("SELECT COUNT\\(s.\\*\\) FROM user_sessions s, users u WHERE s.user_id = u.id").
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+
+	mock.ExpectExec("DELETE FROM ONLY user_sessions WHERE user_id =").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err = p.deleteSession("test-user"); err != nil {
+		t.Errorf("error deleting session: %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+
+	mock.ExpectQuery("SELECT s.name AS name FROM user_sessions s, users u WHERE s.user_id = u.id AND u.username =").
 		WithArgs("test-user").
-		WillReturnRows(sqlmock.NewRows([]string{""}).AddRow("1"))
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("default").AddRow("vice"))
 
-	hasSessions, err := p.hasSessions("test-user")
+	names, err := p.listSessions("test-user")
 	if err != nil {
-		t.Errorf("error from hasSessions(): %s", err)
+		t.Errorf("error from listSessions(): %s", err)
 	}
 
 	if err = mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("expectations were not met: %s", err)
 	}
 
-	if !hasSessions {
-		t.Error("hasSessions() returned false")
+	if !reflect.DeepEqual(names, []string{"default", "vice"}) {
+		t.Errorf("names were %#v instead of [\"default\" \"vice\"]", names)
 	}
 }
 
-func TestGetSessions(t *testing.T) {
+func TestGetSessionByName(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("error creating the mock db: %s", err)
@@ -534,42 +685,104 @@ func TestGetSessions(t *testing.T) {
 	defer db.Close()
 
 	p := NewSessionsDB(db)
-	if p == nil {
-		t.Error("NewSessionsDB returned nil")
+
+	mock.ExpectQuery("SELECT s.id AS id, s.user_id AS user_id, s.session AS session, s.version AS version FROM user_sessions s, users u WHERE s.user_id = u.id AND u.username = ").
+		WithArgs("test-user", "vice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "session", "version"}).AddRow("1", "2", "{}", "3"))
+
+	record, err := p.getSession("test-user", "vice")
+	if err != nil {
+		t.Errorf("error from getSession(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+
+	if record == nil {
+		t.Fatal("getSession() returned a nil record")
 	}
 
-	mock.ExpectQuery("SELECT s.id AS id, s.user_id AS user_id, s.session AS session FROM user_sessions s, users u WHERE s.user_id = u.id AND u.username =").
+	if record.Session != "{}" {
+		t.Errorf("session was %s instead of '{}'", record.Session)
+	}
+
+	if record.Version != 3 {
+		t.Errorf("version was %d instead of 3", record.Version)
+	}
+}
+
+func TestCompareAndSwapSessionHit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
-		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "session"}).AddRow("1", "2", "{}"))
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+
+	mock.ExpectQuery("UPDATE ONLY user_sessions SET session = \\$3, version = version \\+ 1").
+		WithArgs("1", "vice", "{}", int64(3), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("4"))
 
-	records, err := p.getSessions("test-user")
+	newVersion, ok, err := p.compareAndSwapSession("test-user", "vice", 3, "{}", 0)
 	if err != nil {
-		t.Errorf("error from getSessions(): %s", err)
+		t.Errorf("error from compareAndSwapSession(): %s", err)
 	}
 
 	if err = mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("expectations were not met: %s", err)
 	}
 
-	if len(records) != 1 {
-		t.Errorf("number of records returned was %d instead of 1", len(records))
+	if !ok {
+		t.Error("compareAndSwapSession() reported a conflict on a matching version")
+	}
+
+	if newVersion != 4 {
+		t.Errorf("new version was %d instead of 4", newVersion)
+	}
+}
+
+func TestCompareAndSwapSessionMiss(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+
+	mock.ExpectQuery("UPDATE ONLY user_sessions SET session = \\$3, version = version \\+ 1").
+		WithArgs("1", "vice", "{}", int64(2), nil).
+		WillReturnError(sql.ErrNoRows)
+
+	newVersion, ok, err := p.compareAndSwapSession("test-user", "vice", 2, "{}", 0)
+	if err != nil {
+		t.Errorf("error from compareAndSwapSession(): %s", err)
 	}
 
-	session := records[0]
-	if session.UserID != "2" {
-		t.Errorf("user id was %s instead of 2", session.UserID)
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
 	}
 
-	if session.ID != "1" {
-		t.Errorf("id was %s instead of 1", session.ID)
+	if ok {
+		t.Error("compareAndSwapSession() did not report a conflict on a stale version")
 	}
 
-	if session.Session != "{}" {
-		t.Errorf("session was %s instead of '{}'", session.Session)
+	if newVersion != 0 {
+		t.Errorf("new version was %d instead of 0", newVersion)
 	}
 }
 
-func TestInsertSession(t *testing.T) {
+func TestUpsertSession(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("error creating the mock db: %s", err)
@@ -577,20 +790,17 @@ func TestInsertSession(t *testing.T) {
 	defer db.Close()
 
 	p := NewSessionsDB(db)
-	if p == nil {
-		t.Error("NewSessionsDB returned nil")
-	}
 
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
-	mock.ExpectExec("INSERT INTO user_sessions \\(user_id, session\\) VALUES").
-		WithArgs("1", "{}").
+	mock.ExpectExec("INSERT INTO user_sessions \\(user_id, session, name, expires_at\\) VALUES").
+		WithArgs("1", "{}", "vice", nil).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err = p.insertSession("test-user", "{}"); err != nil {
-		t.Errorf("error inserting session: %s", err)
+	if err = p.upsertSession("test-user", "vice", "{}", 0); err != nil {
+		t.Errorf("error upserting session: %s", err)
 	}
 
 	if err = mock.ExpectationsWereMet(); err != nil {
@@ -598,7 +808,10 @@ func TestInsertSession(t *testing.T) {
 	}
 }
 
-func TestUpdateSession(t *testing.T) {
+// TestUpsertSessionPreservesExpiry asserts that an upsert without a TTL
+// binds a nil expires_at parameter, which COALESCE falls back on in the
+// query, rather than clobbering an existing expiry.
+func TestUpsertSessionPreservesExpiry(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("error creating the mock db: %s", err)
@@ -606,20 +819,17 @@ func TestUpdateSession(t *testing.T) {
 	defer db.Close()
 
 	p := NewSessionsDB(db)
-	if p == nil {
-		t.Error("NewSessionsDB returned nil")
-	}
 
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
-	mock.ExpectExec("UPDATE ONLY user_sessions SET session =").
-		WithArgs("1", "{}").
+	mock.ExpectExec("INSERT INTO user_sessions \\(user_id, session, name, expires_at\\) VALUES \\(\\$1, \\$2, \\$3, \\$4\\)\\s*ON CONFLICT \\(user_id, name\\) DO UPDATE SET session = EXCLUDED.session, version = user_sessions.version \\+ 1, expires_at = COALESCE\\(EXCLUDED.expires_at, user_sessions.expires_at\\)").
+		WithArgs("1", "{}", "vice", nil).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err = p.updateSession("test-user", "{}"); err != nil {
-		t.Errorf("error updating session: %s", err)
+	if err = p.upsertSession("test-user", "vice", "{}", 0); err != nil {
+		t.Errorf("error upserting session: %s", err)
 	}
 
 	if err = mock.ExpectationsWereMet(); err != nil {
@@ -627,7 +837,7 @@ func TestUpdateSession(t *testing.T) {
 	}
 }
 
-func TestDeleteSession(t *testing.T) {
+func TestDeleteSessionByName(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("error creating the mock db: %s", err)
@@ -635,23 +845,729 @@ func TestDeleteSession(t *testing.T) {
 	defer db.Close()
 
 	p := NewSessionsDB(db)
-	if p == nil {
-		t.Error("NewSessionsDB returned nil")
-	}
 
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
-	mock.ExpectExec("DELETE FROM ONLY user_sessions WHERE user_id =").
-		WithArgs("1").
+	mock.ExpectExec("DELETE FROM ONLY user_sessions WHERE user_id = ").
+		WithArgs("1", "vice").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err = p.deleteSession("test-user"); err != nil {
-		t.Errorf("error deleting session: %s", err)
+	if err = p.deleteSessionByName("test-user", "vice"); err != nil {
+		t.Errorf("error deleting session by name: %s", err)
 	}
 
 	if err = mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("expectations were not met: %s", err)
 	}
 }
+
+func TestListSessionsRequest(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+
+	mock.users["test-user"] = true
+	if err := mock.upsertSession("test-user", "default", `{"one":"two"}`, 0); err != nil {
+		t.Error(err)
+	}
+	if err := mock.upsertSession("test-user", "vice", `{"three":"four"}`, 0); err != nil {
+		t.Error(err)
+	}
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	res, err := http.Get(fmt.Sprintf("%s/test-user/sessions", server.URL))
+	if err != nil {
+		t.Error(err)
+	}
+	defer res.Body.Close()
+
+	var names []string
+	if err = json.NewDecoder(res.Body).Decode(&names); err != nil {
+		t.Error(err)
+	}
+
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"default", "vice"}) {
+		t.Errorf("names were %#v instead of [\"default\" \"vice\"]", names)
+	}
+}
+
+func TestNamedSlotPutGetDelete(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+
+	username := "test-user"
+	mock.users[username] = true
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s/sessions/vice", server.URL, username)
+	body := []byte(`{"one":"two"}`)
+
+	putReq, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		t.Error(err)
+	}
+	putRes, err := http.DefaultClient.Do(putReq)
+	if err != nil {
+		t.Error(err)
+	}
+	defer putRes.Body.Close()
+
+	var putParsed map[string]map[string]string
+	if err = json.NewDecoder(putRes.Body).Decode(&putParsed); err != nil {
+		t.Error(err)
+	}
+	if _, ok := putParsed["session"]; !ok {
+		t.Error("PUT response did not contain a 'session' key")
+	}
+
+	getRes, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+	}
+	defer getRes.Body.Close()
+
+	getBody, err := ioutil.ReadAll(getRes.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(getBody, body) {
+		t.Errorf("GET returned %s instead of %s", getBody, body)
+	}
+
+	deleteReq, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	deleteRes, err := http.DefaultClient.Do(deleteReq)
+	if err != nil {
+		t.Error(err)
+	}
+	defer deleteRes.Body.Close()
+
+	if deleteRes.StatusCode != http.StatusOK {
+		t.Errorf("DELETE status code was %d instead of %d", deleteRes.StatusCode, http.StatusOK)
+	}
+
+	afterDeleteGet, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+	}
+	defer afterDeleteGet.Body.Close()
+
+	if afterDeleteGet.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after DELETE status code was %d instead of %d", afterDeleteGet.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestWriteSlotRequestConcurrencyControl(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+
+	username := "test-user"
+	mock.users[username] = true
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s/sessions/vice", server.URL, username)
+
+	put := func(body string, ifMatch string, force bool) *http.Response {
+		target := url
+		if force {
+			target += "?force=true"
+		}
+		req, err := http.NewRequest(http.MethodPut, target, bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	firstRes := put(`{"one":"two"}`, "", false)
+	firstRes.Body.Close()
+	if firstRes.StatusCode != http.StatusOK {
+		t.Fatalf("first PUT status code was %d instead of %d", firstRes.StatusCode, http.StatusOK)
+	}
+	if etag := firstRes.Header.Get("ETag"); etag != `"1"` {
+		t.Errorf("ETag after first PUT was %s instead of \"1\"", etag)
+	}
+
+	noHeaderRes := put(`{"one":"three"}`, "", false)
+	noHeaderRes.Body.Close()
+	if noHeaderRes.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("PUT without If-Match status code was %d instead of %d", noHeaderRes.StatusCode, http.StatusPreconditionRequired)
+	}
+
+	staleRes := put(`{"one":"three"}`, `"99"`, false)
+	staleRes.Body.Close()
+	if staleRes.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT with stale If-Match status code was %d instead of %d", staleRes.StatusCode, http.StatusPreconditionFailed)
+	}
+
+	matchRes := put(`{"one":"three"}`, `"1"`, false)
+	defer matchRes.Body.Close()
+	if matchRes.StatusCode != http.StatusOK {
+		t.Errorf("PUT with matching If-Match status code was %d instead of %d", matchRes.StatusCode, http.StatusOK)
+	}
+	if etag := matchRes.Header.Get("ETag"); etag != `"2"` {
+		t.Errorf("ETag after matching PUT was %s instead of \"2\"", etag)
+	}
+
+	forcedRes := put(`{"one":"four"}`, "", true)
+	defer forcedRes.Body.Close()
+	if forcedRes.StatusCode != http.StatusOK {
+		t.Errorf("forced PUT status code was %d instead of %d", forcedRes.StatusCode, http.StatusOK)
+	}
+}
+
+func TestReapExpiredSessions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+
+	mock.ExpectExec("DELETE FROM user_sessions WHERE expires_at < now\\(\\)").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	count, err := p.reapExpiredSessions()
+	if err != nil {
+		t.Errorf("error from reapExpiredSessions(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+
+	if count != 3 {
+		t.Errorf("count was %d instead of 3", count)
+	}
+}
+
+func TestReaperRunsOnSchedule(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+	n := New(p)
+
+	mock.ExpectExec("DELETE FROM user_sessions WHERE expires_at < now\\(\\)").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.Reaper(ctx, time.Hour)
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestHealthzRequest(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	res, err := http.Get(fmt.Sprintf("%s/healthz", server.URL))
+	if err != nil {
+		t.Error(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status code before the reaper starts was %d instead of %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Reaper(ctx, time.Hour)
+
+	time.Sleep(10 * time.Millisecond)
+
+	res2, err := http.Get(fmt.Sprintf("%s/healthz", server.URL))
+	if err != nil {
+		t.Error(err)
+	}
+	defer res2.Body.Close()
+
+	if res2.StatusCode != http.StatusOK {
+		t.Errorf("status code after the reaper starts was %d instead of %d", res2.StatusCode, http.StatusOK)
+	}
+}
+
+func TestExpiredSessionHiddenFromGet(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+
+	mock.users["test-user"] = true
+	if err := mock.upsertSession("test-user", defaultSlot, `{"one":"two"}`, time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	res, err := http.Get(fmt.Sprintf("%s/test-user", server.URL))
+	if err != nil {
+		t.Error(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status code for an expired session was %d instead of %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+// TestWriteWithoutTTLPreservesExpiry asserts that a write which omits the
+// TTL parameter keeps the expiry set by an earlier write, rather than
+// clearing it and making the session permanent.
+func TestWriteWithoutTTLPreservesExpiry(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+
+	mock.users["test-user"] = true
+	if err := mock.upsertSession("test-user", defaultSlot, `{"one":"two"}`, 100*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	putReq, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/test-user?force=true", server.URL), bytes.NewReader([]byte(`{"one":"three"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRes, err := http.DefaultClient.Do(putReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRes.Body.Close()
+
+	if putRes.StatusCode != http.StatusOK {
+		t.Fatalf("PUT status code was %d instead of %d", putRes.StatusCode, http.StatusOK)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	res, err := http.Get(fmt.Sprintf("%s/test-user", server.URL))
+	if err != nil {
+		t.Error(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status code for a session that should have kept its original expiry was %d instead of %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestEventsStreamOnPut(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+
+	mock.users["test-user"] = true
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	eventsReq, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/test-user/events", server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eventsReq = eventsReq.WithContext(ctx)
+
+	eventsRes, err := http.DefaultClient.Do(eventsReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eventsRes.Body.Close()
+
+	reader := bufio.NewReader(eventsRes.Body)
+
+	// give the handler a moment to register its subscription before the PUT fires.
+	time.Sleep(20 * time.Millisecond)
+
+	putReq, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/test-user", server.URL), bytes.NewReader([]byte(`{"one":"two"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRes, err := http.DefaultClient.Do(putReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRes.Body.Close()
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading event stream: %s", err)
+	}
+
+	if !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("event line was %q, expected a data: frame", line)
+	}
+
+	var event Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "data: ")), &event); err != nil {
+		t.Fatalf("error unmarshaling event: %s", err)
+	}
+
+	if event.Name != defaultSlot {
+		t.Errorf("event name was %s instead of %s", event.Name, defaultSlot)
+	}
+
+	if event.Version != 1 {
+		t.Errorf("event version was %d instead of 1", event.Version)
+	}
+}
+
+func TestEventsStreamRemovesDeadSubscribers(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+
+	mock.users["test-user"] = true
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	eventsReq, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/test-user/events", server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	eventsReq = eventsReq.WithContext(ctx)
+
+	eventsRes, err := http.DefaultClient.Do(eventsReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	n.eventsMu.Lock()
+	subCount := len(n.eventSubs["test-user"])
+	n.eventsMu.Unlock()
+	if subCount != 1 {
+		t.Fatalf("subscriber count was %d instead of 1", subCount)
+	}
+
+	eventsRes.Body.Close()
+	cancel()
+
+	time.Sleep(20 * time.Millisecond)
+
+	n.eventsMu.Lock()
+	subCount = len(n.eventSubs["test-user"])
+	n.eventsMu.Unlock()
+	if subCount != 0 {
+		t.Errorf("subscriber count after disconnect was %d instead of 0", subCount)
+	}
+}
+
+func TestIterateSessions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	mock.ExpectQuery("SELECT s.user_id AS user_id, s.session AS session, s.name AS name, s.version AS version, u.username AS username, s.expires_at AS expires_at").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "session", "name", "version", "username", "expires_at"}).
+			AddRow("1", `{"one":"two"}`, "default", "1", "test-user", expiry).
+			AddRow("2", `{"three":"four"}`, "vice", "2", "other-user", nil))
+
+	var seen []UserSessionRecord
+	err = p.iterateSessions(context.Background(), func(record UserSessionRecord) error {
+		seen = append(seen, record)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("error from iterateSessions(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+
+	if len(seen) != 2 {
+		t.Fatalf("saw %d records instead of 2", len(seen))
+	}
+
+	if seen[0].Username != "test-user" || seen[0].Name != "default" {
+		t.Errorf("first record was %#v", seen[0])
+	}
+
+	if seen[0].ExpiresAt == nil || !seen[0].ExpiresAt.Equal(expiry) {
+		t.Errorf("first record's expires_at was %v instead of %v", seen[0].ExpiresAt, expiry)
+	}
+
+	if seen[1].Username != "other-user" || seen[1].Name != "vice" {
+		t.Errorf("second record was %#v", seen[1])
+	}
+
+	if seen[1].ExpiresAt != nil {
+		t.Errorf("second record's expires_at was %v instead of nil", seen[1].ExpiresAt)
+	}
+}
+
+func TestBulkUpsert(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectExec("INSERT INTO user_sessions \\(user_id, session, name, expires_at\\) VALUES").
+		WithArgs("1", `{"one":"two"}`, "default", nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
+
+	records := []UserSessionRecord{
+		{Username: "test-user", Name: "default", Session: `{"one":"two"}`},
+	}
+
+	if err = p.bulkUpsert(context.Background(), records, false); err != nil {
+		t.Errorf("error from bulkUpsert(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestBulkUpsertSkipsUnknownUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("ghost-user").
+		WillReturnError(sql.ErrNoRows)
+
+	mock.ExpectCommit()
+
+	records := []UserSessionRecord{
+		{Username: "ghost-user", Name: "default", Session: `{"one":"two"}`},
+	}
+
+	if err = p.bulkUpsert(context.Background(), records, false); err != nil {
+		t.Errorf("error from bulkUpsert(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestBulkUpsertCreatesMissingUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("new-user").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO users \\(username\\) VALUES").
+		WithArgs("new-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("9"))
+	mock.ExpectExec("INSERT INTO user_sessions \\(user_id, session, name, expires_at\\) VALUES").
+		WithArgs("9", `{"one":"two"}`, "default", nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
+
+	records := []UserSessionRecord{
+		{Username: "new-user", Name: "default", Session: `{"one":"two"}`},
+	}
+
+	if err = p.bulkUpsert(context.Background(), records, true); err != nil {
+		t.Errorf("error from bulkUpsert(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestBulkUpsertRollsBackOnPartialFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewSessionsDB(db)
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectExec("INSERT INTO user_sessions \\(user_id, session, name, expires_at\\) VALUES").
+		WithArgs("1", `{"one":"two"}`, "default", nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("other-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("2"))
+	mock.ExpectExec("INSERT INTO user_sessions \\(user_id, session, name, expires_at\\) VALUES").
+		WithArgs("2", `{"three":"four"}`, "default", nil).
+		WillReturnError(fmt.Errorf("boom"))
+
+	mock.ExpectRollback()
+
+	records := []UserSessionRecord{
+		{Username: "test-user", Name: "default", Session: `{"one":"two"}`},
+		{Username: "other-user", Name: "default", Session: `{"three":"four"}`},
+	}
+
+	if err = p.bulkUpsert(context.Background(), records, false); err == nil {
+		t.Error("expected an error from bulkUpsert() but got nil")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestAdminExportImportRoundTrip(t *testing.T) {
+	os.Setenv("USER_SESSIONS_ADMIN_SECRET", "s3cr3t")
+	defer os.Unsetenv("USER_SESSIONS_ADMIN_SECRET")
+
+	src := NewMockDB()
+	srcSessions := New(src)
+	src.users["test-user"] = true
+	if err := src.upsertSession("test-user", defaultSlot, `{"one":"two"}`, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	srcServer := httptest.NewServer(srcSessions.router)
+	defer srcServer.Close()
+
+	exportReq, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/admin/sessions", srcServer.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportReq.Header.Set("X-Admin-Secret", "s3cr3t")
+
+	exportRes, err := http.DefaultClient.Do(exportReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exportRes.Body.Close()
+
+	ndjson, err := ioutil.ReadAll(exportRes.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exportRes.StatusCode != http.StatusOK {
+		t.Fatalf("export status code was %d instead of %d", exportRes.StatusCode, http.StatusOK)
+	}
+
+	dst := NewMockDB()
+	dstSessions := New(dst)
+	dst.users["test-user"] = true
+
+	dstServer := httptest.NewServer(dstSessions.router)
+	defer dstServer.Close()
+
+	importReq, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/admin/sessions", dstServer.URL), bytes.NewReader(ndjson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	importReq.Header.Set("X-Admin-Secret", "s3cr3t")
+
+	importRes, err := http.DefaultClient.Do(importReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer importRes.Body.Close()
+
+	if importRes.StatusCode != http.StatusOK {
+		t.Fatalf("import status code was %d instead of %d", importRes.StatusCode, http.StatusOK)
+	}
+
+	record, err := dst.getSession("test-user", defaultSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil {
+		t.Fatal("no session was imported")
+	}
+	if record.Session != `{"one":"two"}` {
+		t.Errorf("imported session was %s instead of {\"one\":\"two\"}", record.Session)
+	}
+	if record.ExpiresAt == nil {
+		t.Error("imported session lost its expires_at")
+	}
+}
+
+func TestAdminRequestUnauthorized(t *testing.T) {
+	os.Unsetenv("USER_SESSIONS_ADMIN_SECRET")
+
+	mock := NewMockDB()
+	n := New(mock)
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	res, err := http.Get(fmt.Sprintf("%s/admin/sessions", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status code was %d instead of %d", res.StatusCode, http.StatusUnauthorized)
+	}
+}